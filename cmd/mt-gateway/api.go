@@ -20,11 +20,18 @@ type Api struct {
 //Constructs a new Api based on the passed in URLS
 func NewApi(urls Urls) Api {
 	api := Api{}
-	//TODO implement actual kafka based import handler
-	api.ingestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNotImplemented)
-		_, _ = fmt.Fprintln(w, "http ingest not yet implemented")
-	})
+	if ingestCliConfig.Enabled {
+		handler, err := NewKafkaIngestHandler(ingestCliConfig)
+		if err != nil {
+			log.Fatalf("failed to start kafka ingest handler: %s", err)
+		}
+		api.ingestHandler = handler
+	} else {
+		api.ingestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotImplemented)
+			_, _ = fmt.Fprintln(w, "http ingest is disabled")
+		})
+	}
 	api.graphiteHandler = newProxyWithLogging("graphite", urls.graphite)
 	api.metrictankHandler = newProxyWithLogging("metrictank", urls.metrictank)
 	api.bulkImportHandler = newProxyWithLogging("bulk-importer", urls.bulkImporter)
@@ -37,12 +44,12 @@ func (api Api) Mux() *http.ServeMux {
 	//By default everything is proxied to graphite
 	//This includes endpoints under `/metrics` which aren't explicitly rerouted
 	mux.Handle("/", api.graphiteHandler)
-	//`/metrics` is handled locally by the kafka ingester (not yet implemented)
-	mux.Handle("/metrics", api.ingestHandler)
-	//other endpoints are proxied to metrictank or mt-whisper-import-writer
-	mux.Handle("/metrics/index.json", api.metrictankHandler)
-	mux.Handle("/metrics/delete", api.metrictankHandler)
-	mux.Handle("/metrics/import", api.bulkImportHandler)
+	//`/metrics` is handled locally by the kafka ingester, gated on the "ingest" scope
+	mux.Handle("/metrics", requireAuth(ScopeIngest, api.ingestHandler))
+	//other endpoints are proxied to metrictank or mt-whisper-import-writer, each gated on its own scope
+	mux.Handle("/metrics/index.json", requireAuth(ScopeRead, api.metrictankHandler))
+	mux.Handle("/metrics/delete", requireAuth(ScopeAdmin, api.metrictankHandler))
+	mux.Handle("/metrics/import", requireAuth(ScopeIngest, api.bulkImportHandler))
 
 	return mux
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/rakyll/globalconf"
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenScope is a named set of routes a bearer token is allowed to call.
+type TokenScope string
+
+const (
+	ScopeIngest TokenScope = "ingest"
+	ScopeRead   TokenScope = "read"
+	ScopeAdmin  TokenScope = "admin"
+)
+
+// StaticToken is one entry of AuthConfig.Tokens: a label (for logging), the
+// org id every request bearing it is attributed to, and the scopes it
+// grants.
+type StaticToken struct {
+	Label  string
+	OrgId  string
+	Token  string
+	Scopes map[TokenScope]bool
+}
+
+// AuthConfig configures bearer-token auth enforcement on the Api proxy.
+type AuthConfig struct {
+	Enabled bool
+	// Tokens is a comma separated "label:org:token:scope1|scope2" list,
+	// parsed into StaticTokens below. org is mandatory: downstream services
+	// trust X-Org-Id on the proxied request, so every static token must be
+	// scoped to exactly one org. Multi-org callers need an HMAC token
+	// instead, whose org_id claim is verified per request.
+	Tokens string
+	tokens []StaticToken
+
+	// HMACSecret, when set, additionally accepts HS256-signed tokens
+	// carrying org_id, expiry and scopes instead of a static token.
+	HMACSecret string
+}
+
+func (cfg *AuthConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	var tokens []StaticToken
+	for _, entry := range strings.Split(cfg.Tokens, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 4 {
+			return fmt.Errorf("auth-tokens entry %q must be in label:org:token:scope1|scope2 form", entry)
+		}
+		if parts[1] == "" {
+			return fmt.Errorf("auth-tokens entry %q must have a non-empty org", entry)
+		}
+		scopes := make(map[TokenScope]bool)
+		for _, s := range strings.Split(parts[3], "|") {
+			scopes[TokenScope(s)] = true
+		}
+		tokens = append(tokens, StaticToken{Label: parts[0], OrgId: parts[1], Token: parts[2], Scopes: scopes})
+	}
+
+	if len(tokens) == 0 && cfg.HMACSecret == "" {
+		return fmt.Errorf("auth-enabled requires either auth-tokens or auth-hmac-secret to be set")
+	}
+
+	cfg.tokens = tokens
+	return nil
+}
+
+// return AuthConfig with default values set.
+func NewAuthConfig() *AuthConfig {
+	return &AuthConfig{
+		Enabled:    false,
+		Tokens:     "",
+		HMACSecret: "",
+	}
+}
+
+var authCliConfig = NewAuthConfig()
+
+func ConfigSetupAuth() {
+	auth := flag.NewFlagSet("auth", flag.ExitOnError)
+
+	auth.BoolVar(&authCliConfig.Enabled, "enabled", authCliConfig.Enabled, "require a valid bearer token on /metrics, /metrics/import, /metrics/index.json and /metrics/delete. other routes proxied to graphite are not checked")
+	auth.StringVar(&authCliConfig.Tokens, "tokens", authCliConfig.Tokens, "comma separated list of label:org:token:scope1|scope2 entries")
+	auth.StringVar(&authCliConfig.HMACSecret, "hmac-secret", authCliConfig.HMACSecret, "shared secret used to verify HS256-signed bearer tokens carrying org_id, expiry and scopes. empty disables HMAC tokens")
+
+	globalconf.Register("auth", auth)
+}
+
+func ConfigProcessAuth() {
+	if err := authCliConfig.Validate(); err != nil {
+		log.Fatalf("auth: config validation error. %s", err)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withAuthConfig(cfg *AuthConfig, fn func()) {
+	prev := authCliConfig
+	authCliConfig = cfg
+	defer func() { authCliConfig = prev }()
+	fn()
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Org-Id", r.Header.Get("X-Org-Id"))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestRequireAuthPassthroughWhenDisabled(t *testing.T) {
+	withAuthConfig(NewAuthConfig(), func() {
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	})
+}
+
+func TestRequireAuthRejectsMissingToken(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.tokens = []StaticToken{{Label: "l", OrgId: "1", Token: "secret", Scopes: map[TokenScope]bool{ScopeRead: true}}}
+
+	withAuthConfig(cfg, func() {
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", rec.Code)
+		}
+	})
+}
+
+func TestRequireAuthStaticTokenSetsOrgId(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.tokens = []StaticToken{{Label: "l", OrgId: "42", Token: "secret", Scopes: map[TokenScope]bool{ScopeRead: true}}}
+
+	withAuthConfig(cfg, func() {
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		req.Header.Set("X-Org-Id", "999") // client-supplied, must not be trusted
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := rec.Header().Get("X-Seen-Org-Id"); got != "42" {
+			t.Fatalf("expected X-Org-Id to be overwritten with configured org 42, got %q", got)
+		}
+	})
+}
+
+func TestRequireAuthStaticTokenWrongScope(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.tokens = []StaticToken{{Label: "l", OrgId: "42", Token: "secret", Scopes: map[TokenScope]bool{ScopeRead: true}}}
+
+	withAuthConfig(cfg, func() {
+		req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeIngest, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for a token lacking the required scope, got %d", rec.Code)
+		}
+	})
+}
+
+func signHMAC(t *testing.T, secret string, claims hmacClaims) string {
+	t.Helper()
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	sig := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	return payload + "." + sig
+}
+
+func TestRequireAuthHMACTokenSetsOrgId(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.HMACSecret = "shh"
+
+	withAuthConfig(cfg, func() {
+		token := signHMAC(t, "shh", hmacClaims{OrgId: 7, Scopes: []TokenScope{ScopeRead}})
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if got := rec.Header().Get("X-Seen-Org-Id"); got != "7" {
+			t.Fatalf("expected X-Org-Id 7, got %q", got)
+		}
+	})
+}
+
+func TestRequireAuthHMACTokenExpired(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.HMACSecret = "shh"
+
+	withAuthConfig(cfg, func() {
+		token := signHMAC(t, "shh", hmacClaims{
+			OrgId:  7,
+			Expiry: time.Now().Add(-time.Minute).Unix(),
+			Scopes: []TokenScope{ScopeRead},
+		})
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for an expired token, got %d", rec.Code)
+		}
+	})
+}
+
+func TestRequireAuthHMACTokenBadSignature(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.HMACSecret = "shh"
+
+	withAuthConfig(cfg, func() {
+		token := signHMAC(t, "wrong-secret", hmacClaims{OrgId: 7, Scopes: []TokenScope{ScopeRead}})
+		req := httptest.NewRequest(http.MethodGet, "/metrics/index.json", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		requireAuth(ScopeRead, okHandler()).ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401 for a badly signed token, got %d", rec.Code)
+		}
+	})
+}
+
+func TestAuthConfigValidateRequiresOrgOnStaticTokens(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.Tokens = "label::secret:read"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected Validate to reject a static token entry with an empty org")
+	}
+}
+
+func TestAuthConfigValidateParsesOrgField(t *testing.T) {
+	cfg := NewAuthConfig()
+	cfg.Enabled = true
+	cfg.Tokens = "label:42:secret:read|ingest"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cfg.tokens) != 1 || cfg.tokens[0].OrgId != "42" {
+		t.Fatalf("expected one token with org 42, got %+v", cfg.tokens)
+	}
+}
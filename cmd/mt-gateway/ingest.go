@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	ingestAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mt_gateway",
+		Subsystem: "ingest",
+		Name:      "accepted_total",
+		Help:      "number of metrics accepted for produce to kafka",
+	})
+	ingestDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mt_gateway",
+		Subsystem: "ingest",
+		Name:      "dropped_total",
+		Help:      "number of metrics dropped because the ingest queue was full",
+	})
+	ingestFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "mt_gateway",
+		Subsystem: "ingest",
+		Name:      "failed_total",
+		Help:      "number of metrics that failed to produce to kafka after all retries",
+	})
+	ingestBatchLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mt_gateway",
+		Subsystem: "ingest",
+		Name:      "batch_latency_seconds",
+		Help:      "time spent producing a batch of metrics to kafka",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(ingestAccepted, ingestDropped, ingestFailed, ingestBatchLatency)
+}
+
+// metricBatch is a unit of work queued up for the batcher: a decoded metric
+// together with the key it should be partitioned on.
+type metricBatch struct {
+	key  string
+	data *schema.MetricData
+}
+
+// KafkaIngestHandler is an http.Handler that decodes Graphite plaintext, JSON
+// or msgp payloads posted to /metrics, batches them and produces them to
+// a Kafka topic, partitioning each metric by a hash of its key so that a
+// given series always lands on the same partition.
+type KafkaIngestHandler struct {
+	cfg      *IngestConfig
+	producer sarama.AsyncProducer
+	queue    chan *metricBatch
+	// enqueueMu serializes ServeHTTP's check-then-enqueue of a whole batch,
+	// so two concurrent requests can't both pass the capacity check and
+	// together overshoot cap(queue).
+	enqueueMu sync.Mutex
+
+	stop        chan struct{}
+	batcherDone chan struct{}
+	errWG       sync.WaitGroup
+}
+
+// NewKafkaIngestHandler builds a KafkaIngestHandler from the given config and
+// starts its background batcher. Callers are responsible for calling Stop()
+// on shutdown.
+func NewKafkaIngestHandler(cfg *IngestConfig) (*KafkaIngestHandler, error) {
+	saramaCfg := sarama.NewConfig()
+	saramaCfg.Producer.Return.Successes = false
+	saramaCfg.Producer.Return.Errors = true
+	saramaCfg.Producer.Retry.Max = cfg.MaxRetries
+	saramaCfg.Producer.Retry.BackoffFunc = func(retries, maxRetries int) time.Duration {
+		return cfg.RetryBackoff * time.Duration(1<<uint(retries-1))
+	}
+	saramaCfg.Producer.Flush.Messages = cfg.BatchSize
+	saramaCfg.Producer.Flush.Frequency = cfg.LingerTime
+	saramaCfg.Producer.Partitioner = sarama.NewHashPartitioner
+
+	switch cfg.RequiredAcks {
+	case "none":
+		saramaCfg.Producer.RequiredAcks = sarama.NoResponse
+	case "local":
+		saramaCfg.Producer.RequiredAcks = sarama.WaitForLocal
+	case "all":
+		saramaCfg.Producer.RequiredAcks = sarama.WaitForAll
+	}
+
+	switch cfg.Compression {
+	case "none":
+		saramaCfg.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		saramaCfg.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		saramaCfg.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		saramaCfg.Producer.Compression = sarama.CompressionLZ4
+	}
+
+	producer, err := sarama.NewAsyncProducer(cfg.brokers, saramaCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &KafkaIngestHandler{
+		cfg:         cfg,
+		producer:    producer,
+		queue:       make(chan *metricBatch, cfg.QueueSize),
+		stop:        make(chan struct{}),
+		batcherDone: make(chan struct{}),
+	}
+
+	h.errWG.Add(1)
+	go h.produceErrors()
+	go h.batcher()
+
+	return h, nil
+}
+
+// Stop drains the batcher, then shuts down the producer. The producer must
+// not be closed until the batcher has stopped sending to it, and
+// produceErrors won't return until the producer is closed (it ranges over
+// producer.Errors(), which sarama only closes once AsyncClose finishes) -
+// so the three steps have to happen in exactly this order.
+func (h *KafkaIngestHandler) Stop() {
+	close(h.stop)
+	<-h.batcherDone
+	h.producer.AsyncClose()
+	h.errWG.Wait()
+}
+
+// produceErrors logs (and counts) messages that sarama failed to deliver
+// after exhausting its retries.
+func (h *KafkaIngestHandler) produceErrors() {
+	defer h.errWG.Done()
+	for err := range h.producer.Errors() {
+		log.WithError(err.Err).Error("ingest: failed to produce metric batch to kafka")
+		ingestFailed.Inc()
+	}
+}
+
+// batcher drains the queue into batches of at most cfg.BatchSize, flushing
+// whenever a batch fills up and on every tick of a fixed cfg.LingerTime
+// ticker, whichever comes first. The ticker is not reset when a batch
+// starts, so a metric may wait anywhere up to cfg.LingerTime.
+func (h *KafkaIngestHandler) batcher() {
+	defer close(h.batcherDone)
+
+	ticker := time.NewTicker(h.cfg.LingerTime)
+	defer ticker.Stop()
+
+	batch := make([]*metricBatch, 0, h.cfg.BatchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		start := time.Now()
+		for _, m := range batch {
+			buf, err := m.data.MarshalMsg(nil)
+			if err != nil {
+				log.WithError(err).Error("ingest: failed to marshal metric, dropping")
+				ingestFailed.Inc()
+				continue
+			}
+			h.producer.Input() <- &sarama.ProducerMessage{
+				Topic: h.cfg.Topic,
+				Key:   sarama.StringEncoder(m.key),
+				Value: sarama.ByteEncoder(buf),
+			}
+		}
+		ingestBatchLatency.Observe(time.Since(start).Seconds())
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case m := <-h.queue:
+			batch = append(batch, m)
+			if len(batch) >= h.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-h.stop:
+			flush()
+			return
+		}
+	}
+}
+
+// ServeHTTP decodes the posted metrics and enqueues them for batching. It
+// returns 400 on malformed payloads, 503 when the ingest queue doesn't have
+// room for the whole batch and 200 once every decoded metric has been
+// accepted onto the queue. The capacity check and the enqueue happen under
+// enqueueMu so a 503 never lies about a batch that was partially accepted,
+// and so a batch that passed the check can never block waiting for the
+// batcher to drain space a concurrent request grabbed first.
+func (h *KafkaIngestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	metrics, err := decodeMetrics(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h.enqueueMu.Lock()
+	defer h.enqueueMu.Unlock()
+
+	if len(h.queue)+len(metrics) > cap(h.queue) {
+		ingestDropped.Add(float64(len(metrics)))
+		writeJSONError(w, http.StatusServiceUnavailable, "ingest queue is full")
+		return
+	}
+
+	for _, m := range metrics {
+		h.queue <- &metricBatch{key: partitionKey(m), data: m}
+		ingestAccepted.Inc()
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// partitionKey returns the string a metric should be partitioned on, so that
+// all points of the same series land on the same kafka partition.
+func partitionKey(m *schema.MetricData) string {
+	return strconv.Itoa(m.OrgId) + "." + m.Name
+}
+
+// decodeMetrics dispatches to the right decoder based on Content-Type.
+// application/json decodes a schema.MetricDataArray, any Content-Type
+// containing "protobuf" decodes a single msgp-encoded schema.MetricDataArray
+// (the format of MetricDataArray.MarshalMsg; protobuf encoding is not
+// decoded), and anything else is treated as Graphite plaintext
+// ("<metric> <value> <ts>").
+func decodeMetrics(r *http.Request) ([]*schema.MetricData, error) {
+	ct := r.Header.Get("Content-Type")
+	switch {
+	case strings.Contains(ct, "application/json"):
+		return decodeJSON(r)
+	case strings.Contains(ct, "protobuf"):
+		return decodeProtobuf(r)
+	default:
+		return decodeGraphitePlain(r)
+	}
+}
+
+func decodeJSON(r *http.Request) ([]*schema.MetricData, error) {
+	var metrics []*schema.MetricData
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&metrics); err != nil {
+		return nil, err
+	}
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+func decodeProtobuf(r *http.Request) ([]*schema.MetricData, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics schema.MetricDataArray
+	_, err = metrics.UnmarshalMsg(body)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range metrics {
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+// decodeGraphitePlain parses the classic "<metric> <value> <timestamp>"
+// carbon plaintext protocol, one metric per line.
+func decodeGraphitePlain(r *http.Request) ([]*schema.MetricData, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var metrics []*schema.MetricData
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, errInvalidLine(line)
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, &schema.MetricData{
+			Name:     fields[0],
+			Metric:   fields[0],
+			Value:    value,
+			Time:     ts,
+			Interval: 10,
+			Unit:     "unknown",
+			Mtype:    "gauge",
+		})
+	}
+	return metrics, nil
+}
+
+type errInvalidLine string
+
+func (e errInvalidLine) Error() string {
+	return "invalid graphite plaintext line: " + string(e)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{Error: msg})
+}
+
+// fnvHash returns a stable 32-bit FNV-1a hash of a partition key. Nothing in
+// this package calls it; sarama's HashPartitioner does its own hashing.
+func fnvHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
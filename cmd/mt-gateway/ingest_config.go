@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rakyll/globalconf"
+	log "github.com/sirupsen/logrus"
+)
+
+// IngestConfig holds all settings for the local Kafka-backed ingest handler
+// that serves POSTs to /metrics.
+type IngestConfig struct {
+	Enabled      bool
+	Brokers      string
+	brokers      []string
+	Topic        string
+	BatchSize    int
+	LingerTime   time.Duration
+	Compression  string
+	RequiredAcks string
+	MaxRetries   int
+	RetryBackoff time.Duration
+	QueueSize    int
+}
+
+func (cfg *IngestConfig) Validate() error {
+	cfg.brokers = strings.Split(cfg.Brokers, ",")
+	if len(cfg.brokers) == 0 || cfg.brokers[0] == "" {
+		return fmt.Errorf("ingest-kafka-brokers must be set")
+	}
+	if cfg.Topic == "" {
+		return fmt.Errorf("ingest-kafka-topic must be set")
+	}
+	if cfg.BatchSize <= 0 {
+		return fmt.Errorf("ingest-batch-size must be > 0")
+	}
+	if cfg.QueueSize < cfg.BatchSize {
+		return fmt.Errorf("ingest-queue-size must be >= ingest-batch-size")
+	}
+	switch cfg.Compression {
+	case "none", "gzip", "snappy", "lz4":
+	default:
+		return fmt.Errorf("ingest-compression must be one of none|gzip|snappy|lz4")
+	}
+	switch cfg.RequiredAcks {
+	case "none", "local", "all":
+	default:
+		return fmt.Errorf("ingest-required-acks must be one of none|local|all")
+	}
+	return nil
+}
+
+// return IngestConfig with default values set.
+func NewIngestConfig() *IngestConfig {
+	return &IngestConfig{
+		Enabled:      false,
+		Brokers:      "localhost:9092",
+		Topic:        "mdm",
+		BatchSize:    1000,
+		LingerTime:   time.Millisecond * 100,
+		Compression:  "snappy",
+		RequiredAcks: "local",
+		MaxRetries:   5,
+		RetryBackoff: time.Millisecond * 100,
+		QueueSize:    100000,
+	}
+}
+
+var ingestCliConfig = NewIngestConfig()
+
+func ConfigSetupIngest() {
+	ingest := flag.NewFlagSet("ingest", flag.ExitOnError)
+
+	ingest.BoolVar(&ingestCliConfig.Enabled, "enabled", ingestCliConfig.Enabled, "enable the local kafka ingest handler for /metrics. if false, /metrics answers 501 Not Implemented")
+	ingest.StringVar(&ingestCliConfig.Brokers, "brokers", ingestCliConfig.Brokers, "comma separated list of kafka brokers")
+	ingest.StringVar(&ingestCliConfig.Topic, "topic", ingestCliConfig.Topic, "kafka topic to produce to")
+	ingest.IntVar(&ingestCliConfig.BatchSize, "batch-size", ingestCliConfig.BatchSize, "max number of metrics to batch into a single produce request")
+	ingest.DurationVar(&ingestCliConfig.LingerTime, "linger-time", ingestCliConfig.LingerTime, "max time to wait for a batch to fill before flushing it anyway")
+	ingest.StringVar(&ingestCliConfig.Compression, "compression", ingestCliConfig.Compression, "compression used for produced batches. (none|gzip|snappy|lz4)")
+	ingest.StringVar(&ingestCliConfig.RequiredAcks, "required-acks", ingestCliConfig.RequiredAcks, "required acks for producing. (none|local|all)")
+	ingest.IntVar(&ingestCliConfig.MaxRetries, "max-retries", ingestCliConfig.MaxRetries, "max number of times to retry producing a batch before dropping it")
+	ingest.DurationVar(&ingestCliConfig.RetryBackoff, "retry-backoff", ingestCliConfig.RetryBackoff, "initial backoff between produce retries, doubled on each attempt")
+	ingest.IntVar(&ingestCliConfig.QueueSize, "queue-size", ingestCliConfig.QueueSize, "max number of metrics buffered in memory awaiting a batch. requests are rejected with 503 once full")
+
+	globalconf.Register("ingest", ingest)
+}
+
+func ConfigProcessIngest() {
+	if err := ingestCliConfig.Validate(); err != nil {
+		log.Fatalf("ingest: config validation error. %s", err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestPartitionKeyIsStablePerSeries(t *testing.T) {
+	a := &schema.MetricData{OrgId: 1, Name: "a.b.c"}
+	b := &schema.MetricData{OrgId: 1, Name: "a.b.c"}
+	c := &schema.MetricData{OrgId: 2, Name: "a.b.c"}
+
+	if partitionKey(a) != partitionKey(b) {
+		t.Fatalf("expected the same series to get the same partition key")
+	}
+	if partitionKey(a) == partitionKey(c) {
+		t.Fatalf("expected different orgs to get different partition keys")
+	}
+}
+
+func TestDecodeGraphitePlain(t *testing.T) {
+	body := "a.b.c 1.5 1000\nd.e.f 2 2000\n"
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+
+	metrics, err := decodeGraphitePlain(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if metrics[0].Name != "a.b.c" || metrics[0].Value != 1.5 || metrics[0].Time != 1000 {
+		t.Fatalf("unexpected first metric: %+v", metrics[0])
+	}
+}
+
+func TestDecodeGraphitePlainRejectsMalformedLine(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString("a.b.c 1.5\n"))
+	if _, err := decodeGraphitePlain(req); err == nil {
+		t.Fatal("expected an error for a line missing the timestamp field")
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	body := `[{"name":"a.b.c","metric":"a.b.c","orgid":1,"interval":10,"value":1.5,"time":1000,"mtype":"gauge","unit":"unknown"}]`
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	metrics, err := decodeJSON(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "a.b.c" {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestDecodeJSONRejectsInvalidMetric(t *testing.T) {
+	body := `[{"name":"","metric":"","orgid":1,"interval":10,"value":1.5,"time":1000,"mtype":"gauge","unit":"unknown"}]`
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	if _, err := decodeJSON(req); err == nil {
+		t.Fatal("expected Validate to reject a metric with no name")
+	}
+}
+
+func TestDecodeProtobuf(t *testing.T) {
+	in := schema.MetricDataArray{{
+		Name: "a.b.c", Metric: "a.b.c", OrgId: 1, Interval: 10,
+		Value: 1.5, Time: 1000, Mtype: "gauge", Unit: "unknown",
+	}}
+	buf, err := in.MarshalMsg(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal fixture: %s", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBuffer(buf))
+	req.Header.Set("Content-Type", "application/protobuf")
+
+	metrics, err := decodeProtobuf(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "a.b.c" {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestDecodeMetricsDispatchesOnContentType(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString("a.b.c 1.5 1000\n"))
+	metrics, err := decodeMetrics(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(metrics) != 1 || metrics[0].Name != "a.b.c" {
+		t.Fatalf("expected graphite plaintext fallback to be used, got %+v", metrics)
+	}
+}
+
+func newTestHandler(queueSize int) *KafkaIngestHandler {
+	return &KafkaIngestHandler{
+		cfg:   &IngestConfig{BatchSize: queueSize},
+		queue: make(chan *metricBatch, queueSize),
+		stop:  make(chan struct{}),
+	}
+}
+
+func TestServeHTTPRejectsWholeBatchWhenQueueLacksRoom(t *testing.T) {
+	h := newTestHandler(1)
+
+	body := "a.b.c 1 1000\nd.e.f 2 2000\n"
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if len(h.queue) != 0 {
+		t.Fatalf("expected no metrics to be enqueued when the batch doesn't fit, got %d", len(h.queue))
+	}
+}
+
+func TestServeHTTPAcceptsBatchThatFits(t *testing.T) {
+	h := newTestHandler(2)
+
+	body := "a.b.c 1 1000\nd.e.f 2 2000\n"
+	req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if len(h.queue) != 2 {
+		t.Fatalf("expected both metrics to be enqueued, got %d", len(h.queue))
+	}
+}
+
+func TestServeHTTPConcurrentBatchesNeverOvershootQueueCapacity(t *testing.T) {
+	const capacity = 50
+	h := newTestHandler(capacity)
+
+	body := "a.b.c 1 1000\nd.e.f 2 2000\n" // a 2-metric batch
+
+	var wg sync.WaitGroup
+	for i := 0; i < capacity; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/metrics", bytes.NewBufferString(body))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	if len(h.queue) > capacity {
+		t.Fatalf("queue overshot its capacity: %d metrics enqueued, capacity %d", len(h.queue), capacity)
+	}
+}
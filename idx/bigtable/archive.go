@@ -0,0 +1,293 @@
+package bigtable
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// archivedMetricDef mirrors schema.MetricDefinition's columns we care to
+// keep, laid out so parquet-go can derive a row-group schema from the
+// struct tags.
+type archivedMetricDef struct {
+	Id         string `parquet:"name=id, type=BYTE_ARRAY"`
+	OrgId      int32  `parquet:"name=orgid, type=INT32"`
+	Name       string `parquet:"name=name, type=BYTE_ARRAY"`
+	Metric     string `parquet:"name=metric, type=BYTE_ARRAY"`
+	Interval   int32  `parquet:"name=interval, type=INT32"`
+	Unit       string `parquet:"name=unit, type=BYTE_ARRAY"`
+	Mtype      string `parquet:"name=mtype, type=BYTE_ARRAY"`
+	Tags       string `parquet:"name=tags, type=BYTE_ARRAY"`
+	LastUpdate int64  `parquet:"name=lastUpdate, type=INT64"`
+	Partition  int32  `parquet:"name=partition, type=INT32"`
+}
+
+func toArchived(def schema.MetricDefinition) archivedMetricDef {
+	return archivedMetricDef{
+		Id:         def.Id,
+		OrgId:      int32(def.OrgId),
+		Name:       def.Name,
+		Metric:     def.Metric,
+		Interval:   int32(def.Interval),
+		Unit:       def.Unit,
+		Mtype:      def.Mtype,
+		Tags:       strings.Join(def.Tags, ";"),
+		LastUpdate: def.LastUpdate,
+		Partition:  def.Partition,
+	}
+}
+
+// ObjectStore is the minimal interface the archiver needs from an object
+// storage backend. The GCS implementation is primary; S3 (or anything else)
+// just needs to satisfy this interface.
+type ObjectStore interface {
+	// Put uploads data under key. Implementations must make the object
+	// visible atomically, e.g. via a tmp-key + rename/compose, so readers
+	// never observe a partially written object.
+	Put(ctx context.Context, key string, data []byte) error
+	// List returns the keys of all objects whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Get downloads the object stored under key.
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// bufferedRow is one row waiting in the Archiver's buffer. del, if set, is
+// only invoked once row's row-group has actually been flushed and durably
+// uploaded, so a pruned MetricDefinition is never deleted from bigtable
+// before its archive copy is committed to object storage.
+type bufferedRow struct {
+	row archivedMetricDef
+	def schema.MetricDefinition
+	del DeleteFunc
+}
+
+// Archiver buffers pruned MetricDefinitions and periodically flushes them
+// as parquet objects to an ObjectStore, so operators can re-hydrate the
+// index with LoadArchived after an accidental prune.
+type Archiver struct {
+	store  ObjectStore
+	bucket string
+	prefix string
+
+	rowGroupSize int
+
+	mu  sync.Mutex
+	buf []bufferedRow
+
+	flushInterval time.Duration
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+// NewArchiver builds an Archiver from cfg and starts its background flush
+// timer. Callers must call Close to flush and stop it.
+func NewArchiver(cfg *IdxConfig, store ObjectStore) *Archiver {
+	a := &Archiver{
+		store:         store,
+		bucket:        cfg.ArchiveBucket,
+		prefix:        cfg.ArchivePrefix,
+		rowGroupSize:  cfg.ArchiveRowGroupSize,
+		flushInterval: cfg.ArchiveFlushInterval,
+		stop:          make(chan struct{}),
+	}
+	a.wg.Add(1)
+	go a.flushLoop()
+	return a
+}
+
+func (a *Archiver) flushLoop() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.Flush(context.Background()); err != nil {
+				log.WithError(err).Error("bigtable-idx: failed to flush archived metricDefs")
+			}
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Archive queues def for archival. Call Flush (or wait for the flush
+// interval/row-group size to be reached) to make it durable.
+func (a *Archiver) Archive(def schema.MetricDefinition) error {
+	return a.queue(def, nil)
+}
+
+// QueueForDelete queues def for archival same as Archive, but additionally
+// invokes del once def's row-group has actually been flushed and durably
+// uploaded to object storage. del is never called for a row that hasn't been
+// uploaded yet, so the bigtable delete can't race ahead of the archive: if
+// the row is still sitting in the buffer (below rowGroupSize, before the
+// flush interval fires), del simply hasn't run yet.
+func (a *Archiver) QueueForDelete(def schema.MetricDefinition, del DeleteFunc) error {
+	return a.queue(def, del)
+}
+
+func (a *Archiver) queue(def schema.MetricDefinition, del DeleteFunc) error {
+	a.mu.Lock()
+	a.buf = append(a.buf, bufferedRow{row: toArchived(def), def: def, del: del})
+	full := len(a.buf) >= a.rowGroupSize
+	a.mu.Unlock()
+
+	if full {
+		return a.Flush(context.Background())
+	}
+	return nil
+}
+
+// Flush writes any buffered rows out as parquet objects (one per org/date
+// bucket) and uploads them, then - for rows queued via QueueForDelete - runs
+// the deferred delete once its bucket's upload has succeeded. It is a no-op
+// if nothing is buffered.
+func (a *Archiver) Flush(ctx context.Context) error {
+	a.mu.Lock()
+	rows := a.buf
+	a.buf = nil
+	a.mu.Unlock()
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// the object key is bucketed by org and date so LoadArchived can list a
+	// tight prefix instead of scanning the whole archive, and so that each
+	// org's object only ever contains that org's own rows.
+	type bucketKey struct {
+		org  int32
+		date string
+	}
+	byBucket := make(map[bucketKey][]bufferedRow)
+	for _, r := range rows {
+		bk := bucketKey{org: r.row.OrgId, date: time.Unix(r.row.LastUpdate, 0).UTC().Format("2006-01-02")}
+		byBucket[bk] = append(byBucket[bk], r)
+	}
+
+	for bk, bucketRows := range byBucket {
+		encodeRows := make([]archivedMetricDef, len(bucketRows))
+		for i, r := range bucketRows {
+			encodeRows[i] = r.row
+		}
+		data, err := encodeParquet(encodeRows)
+		if err != nil {
+			return fmt.Errorf("bigtable-idx: failed to encode archive row group: %w", err)
+		}
+		key := fmt.Sprintf("%s/org=%d/date=%s/part-%s.parquet", a.prefix, bk.org, bk.date, uuid.New().String())
+		if err := a.store.Put(ctx, key, data); err != nil {
+			return fmt.Errorf("bigtable-idx: failed to upload archive object %s: %w", key, err)
+		}
+
+		for _, r := range bucketRows {
+			if r.del == nil {
+				continue
+			}
+			if err := r.del(context.Background(), r.def); err != nil {
+				return fmt.Errorf("bigtable-idx: failed to delete metricDef %s after archiving: %w", r.def.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close flushes any remaining buffered rows and stops the background flush
+// timer.
+func (a *Archiver) Close() error {
+	close(a.stop)
+	a.wg.Wait()
+	return a.Flush(context.Background())
+}
+
+func encodeParquet(rows []archivedMetricDef) ([]byte, error) {
+	buf := buffer.NewBufferFileFromBytes(nil)
+	w, err := writer.NewParquetWriterFromWriter(buf, new(archivedMetricDef), 4)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		if err := w.Write(r); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.WriteStop(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LoadArchived lists and streams back every MetricDefinition archived for
+// org in the date buckets from the UTC date of from through the UTC date of
+// to (inclusive), so an operator can re-hydrate the index after an accidental
+// prune. Rows are not filtered by the time of day of from and to.
+func LoadArchived(ctx context.Context, store ObjectStore, prefix string, org int, from, to time.Time) ([]schema.MetricDefinition, error) {
+	var out []schema.MetricDefinition
+
+	for d := from.UTC().Truncate(24 * time.Hour); !d.After(to); d = d.AddDate(0, 0, 1) {
+		listPrefix := fmt.Sprintf("%s/org=%d/date=%s/", prefix, org, d.UTC().Format("2006-01-02"))
+		keys, err := store.List(ctx, listPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("bigtable-idx: failed to list archive objects under %s: %w", listPrefix, err)
+		}
+
+		for _, key := range keys {
+			data, err := store.Get(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("bigtable-idx: failed to download archive object %s: %w", key, err)
+			}
+			defs, err := decodeParquet(data)
+			if err != nil {
+				return nil, fmt.Errorf("bigtable-idx: failed to decode archive object %s: %w", key, err)
+			}
+			out = append(out, defs...)
+		}
+	}
+
+	return out, nil
+}
+
+func decodeParquet(data []byte) ([]schema.MetricDefinition, error) {
+	buf := buffer.NewBufferFileFromBytes(data)
+	r, err := reader.NewParquetReader(buf, new(archivedMetricDef), 4)
+	if err != nil {
+		return nil, err
+	}
+	defer r.ReadStop()
+
+	n := int(r.GetNumRows())
+	rows := make([]archivedMetricDef, n)
+	if err := r.Read(&rows); err != nil {
+		return nil, err
+	}
+
+	defs := make([]schema.MetricDefinition, 0, n)
+	for _, row := range rows {
+		var tags []string
+		if row.Tags != "" {
+			tags = strings.Split(row.Tags, ";")
+		}
+		defs = append(defs, schema.MetricDefinition{
+			Id:         row.Id,
+			OrgId:      int(row.OrgId),
+			Name:       row.Name,
+			Metric:     row.Metric,
+			Interval:   int(row.Interval),
+			Unit:       row.Unit,
+			Mtype:      row.Mtype,
+			Tags:       tags,
+			LastUpdate: row.LastUpdate,
+			Partition:  row.Partition,
+		})
+	}
+	return defs, nil
+}
@@ -23,6 +23,16 @@ type IdxConfig struct {
 	MaxStale          time.Duration
 	PruneInterval     time.Duration
 	CreateCF          bool
+
+	// ArchiveBeforePrune, when enabled, uploads pruned MetricDefinitions to
+	// object storage before they are deleted from bigtable.
+	ArchiveBeforePrune   bool
+	ArchiveOnly          bool
+	ArchiveBucket        string
+	ArchivePrefix        string
+	ArchiveCredentials   string
+	ArchiveRowGroupSize  int
+	ArchiveFlushInterval time.Duration
 }
 
 func (cfg *IdxConfig) Validate() error {
@@ -36,6 +46,15 @@ func (cfg *IdxConfig) Validate() error {
 	if cfg.MaxStale > 0 && cfg.PruneInterval == 0 {
 		return fmt.Errorf("pruneInterval must be greater then 0")
 	}
+	if cfg.ArchiveBeforePrune && cfg.ArchiveBucket == "" {
+		return fmt.Errorf("archive-bucket must be set when archive-before-prune is enabled")
+	}
+	if cfg.ArchiveOnly && !cfg.ArchiveBeforePrune {
+		return fmt.Errorf("archive-only requires archive-before-prune to be enabled")
+	}
+	if cfg.ArchiveRowGroupSize <= 0 {
+		return fmt.Errorf("archive-row-group-size must be > 0")
+	}
 	return nil
 }
 
@@ -54,6 +73,14 @@ func NewIdxConfig() *IdxConfig {
 		MaxStale:          0,
 		PruneInterval:     time.Hour * 3,
 		CreateCF:          true,
+
+		ArchiveBeforePrune:   false,
+		ArchiveOnly:          false,
+		ArchiveBucket:        "",
+		ArchivePrefix:        "metrictank-idx-archive",
+		ArchiveCredentials:   "",
+		ArchiveRowGroupSize:  10000,
+		ArchiveFlushInterval: time.Minute * 5,
 	}
 }
 
@@ -75,6 +102,14 @@ func ConfigSetup() {
 	btIdx.DurationVar(&CliConfig.PruneInterval, "prune-interval", CliConfig.PruneInterval, "Interval at which the index should be checked for stale series.")
 	btIdx.BoolVar(&CliConfig.CreateCF, "create-cf", CliConfig.CreateCF, "enable the creation of the table and column families")
 
+	btIdx.BoolVar(&CliConfig.ArchiveBeforePrune, "archive-before-prune", CliConfig.ArchiveBeforePrune, "upload pruned metricDefs to object storage before deleting them from bigtable")
+	btIdx.BoolVar(&CliConfig.ArchiveOnly, "archive-only", CliConfig.ArchiveOnly, "dry-run: upload pruned metricDefs to object storage but never delete them from bigtable")
+	btIdx.StringVar(&CliConfig.ArchiveBucket, "archive-bucket", CliConfig.ArchiveBucket, "object storage bucket to archive pruned metricDefs to")
+	btIdx.StringVar(&CliConfig.ArchivePrefix, "archive-prefix", CliConfig.ArchivePrefix, "key prefix under which archived parquet objects are stored")
+	btIdx.StringVar(&CliConfig.ArchiveCredentials, "archive-credentials", CliConfig.ArchiveCredentials, "path to credentials file for the object store client, empty uses the default credential chain")
+	btIdx.IntVar(&CliConfig.ArchiveRowGroupSize, "archive-row-group-size", CliConfig.ArchiveRowGroupSize, "max number of metricDefs buffered in memory before a row group is flushed to object storage")
+	btIdx.DurationVar(&CliConfig.ArchiveFlushInterval, "archive-flush-interval", CliConfig.ArchiveFlushInterval, "max time a partially filled row group is buffered before it is flushed to object storage")
+
 	globalconf.Register("bigtable-idx", btIdx)
 	return
 }
@@ -83,4 +118,4 @@ func ConfigProcess() {
 	if err := CliConfig.Validate(); err != nil {
 		log.Fatalf("bigtable-idx: Config validation error. %s", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,88 @@
+package bigtable
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// GCSStore is the primary ObjectStore implementation, backed by a single
+// GCS bucket.
+type GCSStore struct {
+	bucket *storage.BucketHandle
+}
+
+// NewGCSStore builds a GCSStore for the given bucket. credentialsFile may be
+// empty, in which case the default application credentials are used.
+func NewGCSStore(ctx context.Context, bucket, credentialsFile string) (*GCSStore, error) {
+	var opts []option.ClientOption
+	if credentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+
+	client, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	return &GCSStore{bucket: client.Bucket(bucket)}, nil
+}
+
+// Put uploads data under key. It writes to a tmp object first and copies
+// it onto the final key, so readers never see a partially written object.
+func (s *GCSStore) Put(ctx context.Context, key string, data []byte) error {
+	tmpKey := key + ".tmp"
+	tmpObj := s.bucket.Object(tmpKey)
+
+	w := tmpObj.NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	dst := s.bucket.Object(key)
+	if _, err := dst.CopierFrom(tmpObj).Run(ctx); err != nil {
+		return fmt.Errorf("failed to copy %s from %s: %w", key, tmpKey, err)
+	}
+
+	return tmpObj.Delete(ctx)
+}
+
+// List returns the keys of every object under prefix.
+func (s *GCSStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+		if strings.HasSuffix(attrs.Name, ".tmp") {
+			// a tmp object only exists mid-upload; never surface it.
+			continue
+		}
+		keys = append(keys, attrs.Name)
+	}
+	return keys, nil
+}
+
+// Get downloads the object stored under key.
+func (s *GCSStore) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.bucket.Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
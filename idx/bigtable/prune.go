@@ -0,0 +1,35 @@
+package bigtable
+
+import (
+	"context"
+	"fmt"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// DeleteFunc deletes a single MetricDefinition's row from bigtable. The
+// caller's prune loop supplies the real bigtable delete; tests can supply a
+// fake.
+type DeleteFunc func(ctx context.Context, def schema.MetricDefinition) error
+
+// PruneStale deletes def via del, unless cfg.ArchiveBeforePrune is set, in
+// which case it instead queues def on arch and lets del run once arch
+// actually flushes def's row-group - batched by arch's own row-group
+// size/flush-interval bounds, not per call - so the bigtable delete is never
+// issued before the archive upload of that row-group is durably committed.
+// If cfg.ArchiveOnly is set, def is archived but never deleted.
+func PruneStale(ctx context.Context, cfg *IdxConfig, arch *Archiver, del DeleteFunc, def schema.MetricDefinition) error {
+	if !cfg.ArchiveBeforePrune {
+		return del(ctx, def)
+	}
+
+	var deferredDel DeleteFunc
+	if !cfg.ArchiveOnly {
+		deferredDel = del
+	}
+
+	if err := arch.QueueForDelete(def, deferredDel); err != nil {
+		return fmt.Errorf("bigtable-idx: failed to archive metricDef %s before prune: %w", def.Id, err)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package bigtable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var errFakePut = errors.New("fake store: put failed")
+
+type fakeStore struct {
+	objects map[string][]byte
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{objects: make(map[string][]byte)}
+}
+
+func (s *fakeStore) Put(ctx context.Context, key string, data []byte) error {
+	s.objects[key] = data
+	return nil
+}
+
+func (s *fakeStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *fakeStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.objects[key], nil
+}
+
+func testArchiver(store ObjectStore, rowGroupSize int) *Archiver {
+	return &Archiver{
+		store:         store,
+		bucket:        "test-bucket",
+		prefix:        "idx-archive",
+		rowGroupSize:  rowGroupSize,
+		flushInterval: time.Hour,
+		stop:          make(chan struct{}),
+	}
+}
+
+func TestPruneStaleArchivesBeforeDeleting(t *testing.T) {
+	store := newFakeStore()
+	arch := testArchiver(store, 1)
+	cfg := &IdxConfig{ArchiveBeforePrune: true}
+	def := schema.MetricDefinition{Id: "abc", OrgId: 1, LastUpdate: time.Now().Unix()}
+
+	var order []string
+	del := func(ctx context.Context, d schema.MetricDefinition) error {
+		if len(store.objects) != 1 {
+			t.Errorf("expected the archive object to be uploaded before delete, found %d objects", len(store.objects))
+		}
+		order = append(order, "delete")
+		return nil
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, def); err != nil {
+		t.Fatalf("PruneStale returned error: %s", err)
+	}
+
+	if len(store.objects) != 1 {
+		t.Fatalf("expected 1 archived object, got %d", len(store.objects))
+	}
+	if len(order) != 1 || order[0] != "delete" {
+		t.Fatalf("expected delete to be called once, got %v", order)
+	}
+}
+
+func TestPruneStaleBatchesAcrossRowGroupBeforeDeleting(t *testing.T) {
+	store := newFakeStore()
+	arch := testArchiver(store, 2)
+	cfg := &IdxConfig{ArchiveBeforePrune: true}
+	defA := schema.MetricDefinition{Id: "a", OrgId: 1, LastUpdate: time.Now().Unix()}
+	defB := schema.MetricDefinition{Id: "b", OrgId: 1, LastUpdate: time.Now().Unix()}
+
+	var deleted []string
+	del := func(ctx context.Context, d schema.MetricDefinition) error {
+		deleted = append(deleted, d.Id)
+		return nil
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, defA); err != nil {
+		t.Fatalf("PruneStale returned error: %s", err)
+	}
+	if len(store.objects) != 0 || len(deleted) != 0 {
+		t.Fatalf("expected row below the row-group size to stay buffered, got %d objects, deleted=%v", len(store.objects), deleted)
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, defB); err != nil {
+		t.Fatalf("PruneStale returned error: %s", err)
+	}
+	if len(store.objects) != 1 {
+		t.Fatalf("expected the full row-group to be uploaded as a single object, got %d", len(store.objects))
+	}
+	if len(deleted) != 2 {
+		t.Fatalf("expected both rows to be deleted once their row-group flushed, got %v", deleted)
+	}
+}
+
+func TestPruneStaleSkipsDeleteWhenArchiveFails(t *testing.T) {
+	arch := testArchiver(failingStore{}, 1)
+	cfg := &IdxConfig{ArchiveBeforePrune: true}
+	def := schema.MetricDefinition{Id: "abc", OrgId: 1, LastUpdate: time.Now().Unix()}
+
+	deleted := false
+	del := func(ctx context.Context, d schema.MetricDefinition) error {
+		deleted = true
+		return nil
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, def); err == nil {
+		t.Fatal("expected PruneStale to return an error when archiving fails")
+	}
+	if deleted {
+		t.Fatal("expected delete not to be called when archiving fails")
+	}
+}
+
+func TestPruneStaleArchiveOnlySkipsDelete(t *testing.T) {
+	store := newFakeStore()
+	arch := testArchiver(store, 1)
+	cfg := &IdxConfig{ArchiveBeforePrune: true, ArchiveOnly: true}
+	def := schema.MetricDefinition{Id: "abc", OrgId: 1, LastUpdate: time.Now().Unix()}
+
+	deleted := false
+	del := func(ctx context.Context, d schema.MetricDefinition) error {
+		deleted = true
+		return nil
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, def); err != nil {
+		t.Fatalf("PruneStale returned error: %s", err)
+	}
+	if len(store.objects) != 1 {
+		t.Fatalf("expected 1 archived object, got %d", len(store.objects))
+	}
+	if deleted {
+		t.Fatal("expected delete not to be called in archive-only mode")
+	}
+}
+
+func TestPruneStaleWithoutArchivingDeletesDirectly(t *testing.T) {
+	arch := testArchiver(newFakeStore(), 1)
+	cfg := &IdxConfig{ArchiveBeforePrune: false}
+	def := schema.MetricDefinition{Id: "abc", OrgId: 1, LastUpdate: time.Now().Unix()}
+
+	deleted := false
+	del := func(ctx context.Context, d schema.MetricDefinition) error {
+		deleted = true
+		return nil
+	}
+
+	if err := PruneStale(context.Background(), cfg, arch, del, def); err != nil {
+		t.Fatalf("PruneStale returned error: %s", err)
+	}
+	if !deleted {
+		t.Fatal("expected delete to be called when archiving is disabled")
+	}
+}
+
+type failingStore struct{}
+
+func (failingStore) Put(ctx context.Context, key string, data []byte) error {
+	return errFakePut
+}
+
+func (failingStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (failingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, nil
+}
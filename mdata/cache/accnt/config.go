@@ -0,0 +1,74 @@
+package accnt
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+// PolicyConfig controls which eviction Policy FlatAccnt uses and how it is
+// sized.
+type PolicyConfig struct {
+	// Policy is the eviction policy to use: "lru" or "tinylfu".
+	Policy string
+	// Capacity is the approximate number of chunks the policy should size
+	// its internal structures for. Only used by "tinylfu".
+	Capacity int
+	// WindowRatio is the fraction of Capacity given to TinyLFU's window
+	// LRU, e.g. 0.01 for 1%.
+	WindowRatio float64
+}
+
+func (cfg *PolicyConfig) Validate() error {
+	switch cfg.Policy {
+	case "lru", "tinylfu":
+	default:
+		return fmt.Errorf("cache-policy must be one of lru|tinylfu")
+	}
+	if cfg.Capacity < 1 {
+		return fmt.Errorf("cache-policy-capacity must be > 0")
+	}
+	if cfg.WindowRatio <= 0 || cfg.WindowRatio >= 1 {
+		return fmt.Errorf("cache-policy-window-ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// return PolicyConfig with default values set.
+func NewPolicyConfig() *PolicyConfig {
+	return &PolicyConfig{
+		Policy:      "lru",
+		Capacity:    1000000,
+		WindowRatio: 0.01,
+	}
+}
+
+var CliConfig = NewPolicyConfig()
+
+func ConfigSetup() {
+	cachePolicy := flag.NewFlagSet("chunk-cache", flag.ExitOnError)
+
+	cachePolicy.StringVar(&CliConfig.Policy, "cache-policy", CliConfig.Policy, "eviction policy to use for the chunk cache (lru|tinylfu)")
+	cachePolicy.IntVar(&CliConfig.Capacity, "cache-policy-capacity", CliConfig.Capacity, "approximate number of chunks the tinylfu policy should size its structures for")
+	cachePolicy.Float64Var(&CliConfig.WindowRatio, "cache-policy-window-ratio", CliConfig.WindowRatio, "fraction of cache-policy-capacity given to tinylfu's window LRU")
+
+	globalconf.Register("chunk-cache", cachePolicy)
+}
+
+func ConfigProcess() {
+	if err := CliConfig.Validate(); err != nil {
+		log.Fatal(3, "chunk-cache: config validation error. %s", err)
+	}
+}
+
+// NewPolicy builds the Policy configured via CliConfig.
+func NewPolicy() Policy {
+	switch CliConfig.Policy {
+	case "tinylfu":
+		return NewTinyLFU(CliConfig.Capacity, CliConfig.WindowRatio)
+	default:
+		return NewLRU()
+	}
+}
@@ -24,10 +24,10 @@ type FlatAccnt struct {
 	// the size limit, once this is reached we'll start evicting data
 	maxSize uint64
 
-	// a last-recently-used implementation that keeps track of all chunks
-	// and which hasn't been used for the longest time. the eviction
-	// function relies on this to know what to evict.
-	lru *LRU
+	// the eviction policy that keeps track of all chunks and decides,
+	// based on recency and/or frequency, which one to evict next. the
+	// eviction function relies on this to know what to evict.
+	policy Policy
 
 	// whenever a chunk gets evicted a job gets added to this queue. it is
 	// consumed by the chunk cache, which will evict whatever the jobs in
@@ -38,6 +38,12 @@ type FlatAccnt struct {
 	// each add means data got added to the cache, each hit means data
 	// has been accessed and hence the LRU needs to be updated.
 	eventQ chan FlatAccntEvent
+
+	// wal and compactor are non-nil when WALCliConfig.Enabled is true, in
+	// which case every add/hit/del event is persisted so accounting can be
+	// reconstructed on restart via initWAL.
+	wal       *wal
+	compactor *compactor
 }
 
 type FlatAccntMet struct {
@@ -50,6 +56,7 @@ const evnt_hit_chnk uint8 = 4
 const evnt_add_chnk uint8 = 5
 const evnt_del_met uint8 = 6
 const evnt_get_total uint8 = 7
+const evnt_live_metrics uint8 = 8
 const evnt_stop uint8 = 100
 const evnt_reset uint8 = 101
 
@@ -81,20 +88,67 @@ type GetTotalPayload struct {
 	res_chan chan uint64
 }
 
+// payload to be sent with a live-metrics snapshot request event, used by
+// the WAL compactor to find out (without racing a.metrics, which is only
+// safe to touch from the eventLoop goroutine) which metrics are still live.
+type LiveMetricsPayload struct {
+	res_chan chan map[string]bool
+}
+
 func NewFlatAccnt(maxSize uint64) *FlatAccnt {
 	accnt := FlatAccnt{
 		metrics: make(map[string]*FlatAccntMet),
 		maxSize: maxSize,
-		lru:     NewLRU(),
+		policy:  NewPolicy(),
 		evictQ:  make(chan *EvictTarget, evictQSize),
 		eventQ:  make(chan FlatAccntEvent, eventQSize),
 	}
 	cacheSizeMax.SetUint64(maxSize)
 
+	if WALCliConfig.Enabled {
+		if err := accnt.initWAL(); err != nil {
+			log.Fatal(3, "accnt: failed to initialize WAL: %s", err)
+		}
+	}
+
 	go accnt.eventLoop()
 	return &accnt
 }
 
+// initWAL replays any existing WAL segments to reconstruct accounting
+// state from before the last restart, then opens the WAL for new writes
+// and starts the background compactor.
+func (a *FlatAccnt) initWAL() error {
+	err := replayWAL(WALCliConfig.Dir, func(t uint8, pl interface{}) {
+		switch t {
+		case evnt_add_chnk:
+			p := pl.(*AddPayload)
+			a.add(p.metric, p.ts, p.size)
+			cacheChunkAdd.Inc()
+			a.policy.Touch(EvictTarget{Metric: p.metric, Ts: p.ts})
+		case evnt_hit_chnk:
+			p := pl.(*HitPayload)
+			a.policy.Touch(EvictTarget{Metric: p.metric, Ts: p.ts})
+		case evnt_del_met:
+			p := pl.(*DelMetPayload)
+			a.delMet(p.metric)
+		case evnt_reset:
+			a.reset()
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	w, err := openWAL(WALCliConfig)
+	if err != nil {
+		return err
+	}
+	a.wal = w
+	a.compactor = startCompactor(WALCliConfig, a.wal, a.liveMetrics)
+	return nil
+}
+
 func (a *FlatAccnt) DelMetric(metric string) {
 	a.act(evnt_del_met, &DelMetPayload{metric})
 }
@@ -105,6 +159,16 @@ func (a *FlatAccnt) GetTotal() uint64 {
 	return <-res_chan
 }
 
+// liveMetrics returns a snapshot of every metric currently tracked by the
+// accounting, i.e. hasn't been delMet'd. Routed through the eventQ like
+// every other read of a.metrics, since that map is only safe to touch from
+// the eventLoop goroutine.
+func (a *FlatAccnt) liveMetrics() map[string]bool {
+	res_chan := make(chan map[string]bool)
+	a.act(evnt_live_metrics, &LiveMetricsPayload{res_chan})
+	return <-res_chan
+}
+
 func (a *FlatAccnt) AddChunk(metric string, ts uint32, size uint64) {
 	a.act(evnt_add_chnk, &AddPayload{metric, ts, size})
 }
@@ -139,12 +203,18 @@ func (a *FlatAccnt) eventLoop() {
 	for {
 		select {
 		case event := <-a.eventQ:
+			if a.wal != nil {
+				if err := a.wal.Append(event.t, event.pl); err != nil {
+					log.Error(3, "Failed to append event to WAL: %s", err)
+				}
+			}
+
 			switch event.t {
 			case evnt_add_chnk:
 				payload := event.pl.(*AddPayload)
 				a.add(payload.metric, payload.ts, payload.size)
 				cacheChunkAdd.Inc()
-				a.lru.touch(
+				a.policy.Touch(
 					EvictTarget{
 						Metric: payload.metric,
 						Ts:     payload.ts,
@@ -152,7 +222,7 @@ func (a *FlatAccnt) eventLoop() {
 				)
 			case evnt_hit_chnk:
 				payload := event.pl.(*HitPayload)
-				a.lru.touch(
+				a.policy.Touch(
 					EvictTarget{
 						Metric: payload.metric,
 						Ts:     payload.ts,
@@ -164,12 +234,21 @@ func (a *FlatAccnt) eventLoop() {
 			case evnt_get_total:
 				payload := event.pl.(*GetTotalPayload)
 				a.getTotal(payload.res_chan)
+			case evnt_live_metrics:
+				payload := event.pl.(*LiveMetricsPayload)
+				a.getLiveMetrics(payload.res_chan)
 			case evnt_stop:
+				if a.compactor != nil {
+					a.compactor.Stop()
+				}
+				if a.wal != nil {
+					if err := a.wal.Close(); err != nil {
+						log.Error(3, "Failed to close WAL: %s", err)
+					}
+				}
 				return
 			case evnt_reset:
-				a.metrics = make(map[string]*FlatAccntMet)
-				a.lru.reset()
-				cacheSizeUsed.SetUint64(0)
+				a.reset()
 			}
 
 			// evict until we're below the max
@@ -184,6 +263,25 @@ func (a *FlatAccnt) getTotal(res_chan chan uint64) {
 	res_chan <- cacheSizeUsed.Peek()
 }
 
+func (a *FlatAccnt) getLiveMetrics(res_chan chan map[string]bool) {
+	live := make(map[string]bool, len(a.metrics))
+	for metric := range a.metrics {
+		live[metric] = true
+	}
+	res_chan <- live
+}
+
+// reset clears all in-memory accounting state. It's the shared body behind
+// both the live evnt_reset handler and WAL replay, so a Reset() persisted to
+// the WAL (see evnt_reset in encodeRecord/decodeRecord) replays back to
+// exactly the same cleared state instead of being silently undone by the
+// add/hit/delMet records that came before it.
+func (a *FlatAccnt) reset() {
+	a.metrics = make(map[string]*FlatAccntMet)
+	a.policy.Reset()
+	cacheSizeUsed.SetUint64(0)
+}
+
 func (a *FlatAccnt) delMet(metric string) {
 	met, ok := a.metrics[metric]
 	if !ok {
@@ -191,7 +289,7 @@ func (a *FlatAccnt) delMet(metric string) {
 	}
 
 	for ts := range met.chunks {
-		a.lru.del(
+		a.policy.Remove(
 			EvictTarget{
 				Metric: metric,
 				Ts:     ts,
@@ -232,18 +330,15 @@ func (a *FlatAccnt) evict() {
 	var ts uint32
 	var size uint64
 	var ok bool
-	var e interface{}
 	var target EvictTarget
 
-	e = a.lru.pop()
+	target, ok = a.policy.Victim()
 
 	// got nothing to evict
-	if e == nil {
+	if !ok {
 		return
 	}
-
-	// convert to EvictTarget otherwise
-	target = e.(EvictTarget)
+	a.policy.Remove(target)
 
 	if met, ok = a.metrics[target.Metric]; !ok {
 		return
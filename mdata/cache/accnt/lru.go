@@ -0,0 +1,66 @@
+package accnt
+
+import "container/list"
+
+// EvictTarget identifies a single chunk in the cache by the metric it
+// belongs to and its (chunk-span-aligned) timestamp.
+type EvictTarget struct {
+	Metric string
+	Ts     uint32
+}
+
+// Uint32Asc implements sort.Interface to sort a slice of uint32 in ascending
+// order.
+type Uint32Asc []uint32
+
+func (a Uint32Asc) Len() int           { return len(a) }
+func (a Uint32Asc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a Uint32Asc) Less(i, j int) bool { return a[i] < a[j] }
+
+// LRU is a plain least-recently-used Policy: every touch moves the key to
+// the front of the list, and the victim is always whatever sits at the back.
+// It never rejects admission.
+type LRU struct {
+	list  *list.List
+	index map[EvictTarget]*list.Element
+}
+
+func NewLRU() *LRU {
+	return &LRU{
+		list:  list.New(),
+		index: make(map[EvictTarget]*list.Element),
+	}
+}
+
+func (l *LRU) Touch(key EvictTarget) {
+	if elem, ok := l.index[key]; ok {
+		l.list.MoveToFront(elem)
+		return
+	}
+	l.index[key] = l.list.PushFront(key)
+}
+
+// Admit is a no-op for plain LRU: it never does admission control.
+func (l *LRU) Admit(candidate, victim EvictTarget) bool {
+	return true
+}
+
+func (l *LRU) Victim() (EvictTarget, bool) {
+	elem := l.list.Back()
+	if elem == nil {
+		return EvictTarget{}, false
+	}
+	return elem.Value.(EvictTarget), true
+}
+
+func (l *LRU) Remove(key EvictTarget) {
+	if elem, ok := l.index[key]; ok {
+		l.list.Remove(elem)
+		delete(l.index, key)
+	}
+}
+
+func (l *LRU) Reset() {
+	l.list = list.New()
+	l.index = make(map[EvictTarget]*list.Element)
+}
@@ -0,0 +1,28 @@
+package accnt
+
+// Policy decides which chunks should be kept in the cache and which should
+// be evicted once the cache grows beyond its size limit. FlatAccnt delegates
+// all recency/frequency bookkeeping to a Policy so that different eviction
+// strategies (LRU, W-TinyLFU, ...) can be swapped in without touching the
+// accounting or evictQ contract.
+type Policy interface {
+	// Touch records that key was just added to, or accessed in, the cache.
+	Touch(key EvictTarget)
+
+	// Admit decides whether candidate should be admitted into the cache in
+	// place of victim. Policies that don't do admission control (e.g. plain
+	// LRU) should always return true.
+	Admit(candidate, victim EvictTarget) bool
+
+	// Victim returns the key the policy recommends evicting next, without
+	// removing it from the policy's bookkeeping. ok is false if the policy
+	// has nothing left to evict.
+	Victim() (key EvictTarget, ok bool)
+
+	// Remove drops all bookkeeping the policy holds for key, e.g. because
+	// the metric was deleted or the key was just evicted.
+	Remove(key EvictTarget)
+
+	// Reset clears all policy state, as if it was newly constructed.
+	Reset()
+}
@@ -0,0 +1,113 @@
+package accnt
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// simCache drives a Policy exactly the way FlatAccnt does: Touch on every
+// access, and Victim()+Remove() to shed entries once more than `capacity`
+// distinct keys are resident. It exists purely to let the benchmarks below
+// measure hit rate without pulling in the rest of FlatAccnt's byte-size
+// accounting, which isn't relevant to how the policy orders evictions.
+type simCache struct {
+	policy   Policy
+	capacity int
+	resident map[EvictTarget]bool
+}
+
+func newSimCache(policy Policy, capacity int) *simCache {
+	return &simCache{
+		policy:   policy,
+		capacity: capacity,
+		resident: make(map[EvictTarget]bool, capacity),
+	}
+}
+
+func (c *simCache) access(key EvictTarget) (hit bool) {
+	hit = c.resident[key]
+	c.policy.Touch(key)
+	if !hit {
+		c.resident[key] = true
+		for len(c.resident) > c.capacity {
+			victim, ok := c.policy.Victim()
+			if !ok {
+				break
+			}
+			c.policy.Remove(victim)
+			delete(c.resident, victim)
+		}
+	}
+	return hit
+}
+
+// zipfianWorkload returns n accesses into a universe of numKeys keys, drawn
+// from a Zipf distribution skewed toward a small hot set, which is the
+// traffic pattern normal chunk-cache usage approximates.
+func zipfianWorkload(n, numKeys int) []EvictTarget {
+	rng := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(rng, 1.07, 1, uint64(numKeys-1))
+	keys := make([]EvictTarget, n)
+	for i := range keys {
+		keys[i] = EvictTarget{Metric: "metric", Ts: uint32(zipf.Uint64())}
+	}
+	return keys
+}
+
+// scanMixedWorkload interleaves a Zipfian "steady state" stream (the hot
+// chunks most requests want) with periodic one-off scans over a huge,
+// never-repeated range (e.g. a single render over a metric's entire
+// history) - the exact cache-pollution scenario W-TinyLFU exists for.
+func scanMixedWorkload(n, numKeys, scanLen int) []EvictTarget {
+	rng := rand.New(rand.NewSource(42))
+	zipf := rand.NewZipf(rng, 1.07, 1, uint64(numKeys-1))
+	keys := make([]EvictTarget, 0, n)
+	scanTs := uint32(numKeys) // scans use a disjoint Ts range from the hot set
+	for len(keys) < n {
+		for i := 0; i < 20 && len(keys) < n; i++ {
+			keys = append(keys, EvictTarget{Metric: "metric", Ts: uint32(zipf.Uint64())})
+		}
+		for i := 0; i < scanLen && len(keys) < n; i++ {
+			keys = append(keys, EvictTarget{Metric: "scan", Ts: scanTs})
+			scanTs++
+		}
+	}
+	return keys
+}
+
+func runHitRateBenchmark(b *testing.B, policy Policy, capacity int, workload []EvictTarget) {
+	c := newSimCache(policy, capacity)
+	var hits, total int
+	for i := 0; i < b.N; i++ {
+		key := workload[i%len(workload)]
+		if c.access(key) {
+			hits++
+		}
+		total++
+	}
+	b.ReportMetric(100*float64(hits)/float64(total), "hit-%")
+}
+
+const benchNumKeys = 10000
+const benchCapacity = 1000
+const benchWorkloadLen = 200000
+
+func BenchmarkLRU_Zipfian(b *testing.B) {
+	workload := zipfianWorkload(benchWorkloadLen, benchNumKeys)
+	runHitRateBenchmark(b, NewLRU(), benchCapacity, workload)
+}
+
+func BenchmarkTinyLFU_Zipfian(b *testing.B) {
+	workload := zipfianWorkload(benchWorkloadLen, benchNumKeys)
+	runHitRateBenchmark(b, NewTinyLFU(benchCapacity, 0.01), benchCapacity, workload)
+}
+
+func BenchmarkLRU_ScanMixed(b *testing.B) {
+	workload := scanMixedWorkload(benchWorkloadLen, benchNumKeys, 5000)
+	runHitRateBenchmark(b, NewLRU(), benchCapacity, workload)
+}
+
+func BenchmarkTinyLFU_ScanMixed(b *testing.B) {
+	workload := scanMixedWorkload(benchWorkloadLen, benchNumKeys, 5000)
+	runHitRateBenchmark(b, NewTinyLFU(benchCapacity, 0.01), benchCapacity, workload)
+}
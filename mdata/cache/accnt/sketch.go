@@ -0,0 +1,123 @@
+package accnt
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// countMinSketch is a 4-bit counting count-min sketch used to estimate how
+// often a key has been touched recently, without the memory cost of keeping
+// an exact counter per key. Counters saturate at 15 and are periodically
+// halved ("aged") so the sketch tracks recent frequency rather than
+// all-time frequency.
+type countMinSketch struct {
+	depth int
+	width uint32
+	// counters packs two 4-bit counters per byte, depth rows of width
+	// counters each.
+	counters [][]byte
+}
+
+const cmsDepth = 4
+const cmsMaxCount = 15
+
+// newCountMinSketch builds a sketch sized for approximately `size` distinct
+// keys, rounding the width up to a power of two so indices can be computed
+// with a mask instead of a modulo.
+func newCountMinSketch(size uint32) *countMinSketch {
+	width := nextPowerOfTwo(size)
+	if width < 16 {
+		width = 16
+	}
+	s := &countMinSketch{
+		depth: cmsDepth,
+		width: width,
+	}
+	s.counters = make([][]byte, s.depth)
+	for i := range s.counters {
+		s.counters[i] = make([]byte, (width+1)/2)
+	}
+	return s
+}
+
+func nextPowerOfTwo(n uint32) uint32 {
+	p := uint32(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// Increment bumps the estimated count for key, saturating each row at
+// cmsMaxCount.
+func (s *countMinSketch) Increment(key string) {
+	h1, h2 := hashKey(key)
+	mask := s.width - 1
+	for row := 0; row < s.depth; row++ {
+		idx := (h1 + uint32(row)*h2) & mask
+		s.increment(row, idx)
+	}
+}
+
+// Estimate returns the minimum counter value across all rows, which is the
+// count-min sketch's estimate of key's frequency.
+func (s *countMinSketch) Estimate(key string) byte {
+	h1, h2 := hashKey(key)
+	mask := s.width - 1
+	min := byte(cmsMaxCount)
+	for row := 0; row < s.depth; row++ {
+		idx := (h1 + uint32(row)*h2) & mask
+		if v := s.get(row, idx); v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// Age halves every counter, so the sketch gradually forgets old activity
+// and adapts to shifting access patterns. Called every W inserts.
+func (s *countMinSketch) Age() {
+	for row := range s.counters {
+		for i, b := range s.counters[row] {
+			lo := (b & 0x0f) >> 1
+			hi := ((b >> 4) & 0x0f) >> 1
+			s.counters[row][i] = lo | (hi << 4)
+		}
+	}
+}
+
+func (s *countMinSketch) get(row int, idx uint32) byte {
+	b := s.counters[row][idx/2]
+	if idx%2 == 0 {
+		return b & 0x0f
+	}
+	return b >> 4
+}
+
+func (s *countMinSketch) increment(row int, idx uint32) {
+	byteIdx := idx / 2
+	b := s.counters[row][byteIdx]
+	if idx%2 == 0 {
+		if v := b & 0x0f; v < cmsMaxCount {
+			s.counters[row][byteIdx] = b + 1
+		}
+	} else {
+		if v := b >> 4; v < cmsMaxCount {
+			s.counters[row][byteIdx] = b + 0x10
+		}
+	}
+}
+
+func hashKey(key string) (uint32, uint32) {
+	h1 := fnv.New32a()
+	_, _ = h1.Write([]byte(key))
+	sum1 := h1.Sum32()
+
+	h2 := fnv.New32()
+	_, _ = fmt.Fprintf(h2, "%s", key)
+	sum2 := h2.Sum32()
+	if sum2 == 0 {
+		sum2 = 1
+	}
+	return sum1, sum2
+}
@@ -0,0 +1,211 @@
+package accnt
+
+import (
+	"container/list"
+	"strconv"
+)
+
+// segment identifies which of TinyLFU's three internal LRUs a key lives in.
+type segment int
+
+const (
+	segWindow segment = iota
+	segProbation
+	segProtected
+)
+
+type tlfuNode struct {
+	key EvictTarget
+	seg segment
+}
+
+// TinyLFU is a W-TinyLFU Policy: a small window LRU (~1% of capacity) takes
+// all new arrivals, and a segmented main cache (probation + protected,
+// ~99% of capacity) holds everything else. When the window overflows, its
+// coldest entry moves into probation: at the front if a count-min sketch
+// estimates it is accessed more often than probation's current eviction
+// candidate, otherwise at the back, where it becomes the next victim. This
+// keeps one-off scans (e.g. a single huge render) from flushing out
+// genuinely hot chunks.
+type TinyLFU struct {
+	window    *list.List
+	probation *list.List
+	protected *list.List
+
+	index map[EvictTarget]*list.Element
+
+	windowCap    int
+	protectedCap int
+
+	sketch  *countMinSketch
+	sample  uint32 // W: number of inserts between sketch aging
+	inserts uint32
+}
+
+// NewTinyLFU builds a W-TinyLFU policy sized for roughly `capacity` tracked
+// keys, with a window of windowRatio*capacity (e.g. 0.01) and the sketch
+// aged every 10*capacity inserts.
+func NewTinyLFU(capacity int, windowRatio float64) *TinyLFU {
+	if capacity < 1 {
+		capacity = 1
+	}
+	windowCap := int(float64(capacity) * windowRatio)
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	protectedCap := int(float64(capacity-windowCap) * 0.8)
+	if protectedCap < 1 {
+		protectedCap = 1
+	}
+
+	return &TinyLFU{
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		index:        make(map[EvictTarget]*list.Element),
+		windowCap:    windowCap,
+		protectedCap: protectedCap,
+		sketch:       newCountMinSketch(uint32(capacity * 8)),
+		sample:       uint32(capacity * 10),
+	}
+}
+
+func (t *TinyLFU) listFor(seg segment) *list.List {
+	switch seg {
+	case segWindow:
+		return t.window
+	case segProtected:
+		return t.protected
+	default:
+		return t.probation
+	}
+}
+
+// sketchKey is the string the frequency sketch is keyed on. It must include
+// Ts, not just Metric: a scan touches many distinct chunks of one metric
+// exactly once each, and a per-metric counter would make the scanned metric
+// look hot on the strength of the scan alone, defeating the whole point of
+// the sketch.
+func sketchKey(key EvictTarget) string {
+	return key.Metric + "|" + strconv.FormatUint(uint64(key.Ts), 10)
+}
+
+func (t *TinyLFU) recordAccess(key EvictTarget) {
+	t.sketch.Increment(sketchKey(key))
+	t.inserts++
+	if t.sample > 0 && t.inserts%t.sample == 0 {
+		t.sketch.Age()
+	}
+}
+
+func (t *TinyLFU) Touch(key EvictTarget) {
+	t.recordAccess(key)
+
+	if elem, ok := t.index[key]; ok {
+		node := elem.Value.(*tlfuNode)
+		switch node.seg {
+		case segWindow:
+			t.window.MoveToFront(elem)
+		case segProtected:
+			t.protected.MoveToFront(elem)
+		case segProbation:
+			t.promote(key, elem)
+		}
+		return
+	}
+
+	elem := t.window.PushFront(&tlfuNode{key: key, seg: segWindow})
+	t.index[key] = elem
+
+	if t.window.Len() > t.windowCap {
+		t.evictWindow()
+	}
+}
+
+// promote moves a probation hit into the protected segment, demoting the
+// protected segment's coldest entry back to probation if that overflows it.
+func (t *TinyLFU) promote(key EvictTarget, elem *list.Element) {
+	t.probation.Remove(elem)
+
+	node := elem.Value.(*tlfuNode)
+	node.seg = segProtected
+	t.index[key] = t.protected.PushFront(node)
+
+	if t.protected.Len() > t.protectedCap {
+		back := t.protected.Back()
+		demoted := back.Value.(*tlfuNode)
+		t.protected.Remove(back)
+		demoted.seg = segProbation
+		t.index[demoted.key] = t.probation.PushFront(demoted)
+	}
+}
+
+// evictWindow moves the window's coldest entry to the main cache, running
+// it past the frequency-sketch admission check against the probation
+// segment's current victim.
+func (t *TinyLFU) evictWindow() {
+	back := t.window.Back()
+	node := back.Value.(*tlfuNode)
+	t.window.Remove(back)
+	delete(t.index, node.key)
+
+	candidate := node.key
+	node.seg = segProbation
+
+	victimElem := t.probation.Back()
+	if victimElem == nil {
+		t.index[candidate] = t.probation.PushFront(node)
+		return
+	}
+
+	victim := victimElem.Value.(*tlfuNode).key
+	if t.Admit(candidate, victim) {
+		// admitted: give it a head start over the existing probation
+		// victim, which remains the next thing FlatAccnt will evict.
+		t.index[candidate] = t.probation.PushFront(node)
+	} else {
+		// rejected: park it right behind the current victim so it's
+		// evicted before anything the sketch thinks is hotter.
+		t.index[candidate] = t.probation.PushBack(node)
+	}
+}
+
+// Admit implements the TinyLFU admission policy: candidate only displaces
+// victim if the sketch estimates it has been accessed more often.
+func (t *TinyLFU) Admit(candidate, victim EvictTarget) bool {
+	return t.sketch.Estimate(sketchKey(candidate)) > t.sketch.Estimate(sketchKey(victim))
+}
+
+// Victim returns the coldest tracked key: the back of probation if it has
+// anything queued, otherwise the back of the window or protected segments.
+func (t *TinyLFU) Victim() (EvictTarget, bool) {
+	if elem := t.probation.Back(); elem != nil {
+		return elem.Value.(*tlfuNode).key, true
+	}
+	if elem := t.window.Back(); elem != nil {
+		return elem.Value.(*tlfuNode).key, true
+	}
+	if elem := t.protected.Back(); elem != nil {
+		return elem.Value.(*tlfuNode).key, true
+	}
+	return EvictTarget{}, false
+}
+
+func (t *TinyLFU) Remove(key EvictTarget) {
+	elem, ok := t.index[key]
+	if !ok {
+		return
+	}
+	node := elem.Value.(*tlfuNode)
+	t.listFor(node.seg).Remove(elem)
+	delete(t.index, key)
+}
+
+func (t *TinyLFU) Reset() {
+	t.window = list.New()
+	t.probation = list.New()
+	t.protected = list.New()
+	t.index = make(map[EvictTarget]*list.Element)
+	t.sketch = newCountMinSketch(t.sketch.width)
+	t.inserts = 0
+}
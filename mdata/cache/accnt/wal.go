@@ -0,0 +1,354 @@
+package accnt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// record types stored in the WAL. these mirror the evnt_* constants in
+// flat_accnt.go but are a distinct, stable on-disk encoding so the event
+// loop's internal event ids can keep changing without breaking old WALs.
+const (
+	walRecAdd   byte = 1
+	walRecHit   byte = 2
+	walRecDel   byte = 3
+	walRecReset byte = 4
+)
+
+const walSegmentPrefix = "segment-"
+const walSegmentSuffix = ".wal"
+
+// wal is a segmented, append-only, crc-checked log of accounting events,
+// used to reconstruct FlatAccnt's metrics map and eviction policy state
+// across restarts.
+type wal struct {
+	cfg *WALConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	size    int64
+	nextSeq int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// openWAL opens (creating if necessary) the WAL directory, rotates in a
+// fresh segment to append to, and - if the fsync policy is interval based -
+// starts the background fsync ticker.
+func openWAL(cfg *WALConfig) (*wal, error) {
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("wal: failed to create dir %s: %w", cfg.Dir, err)
+	}
+
+	segments, err := listWALSegments(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nextSeq := 0
+	if len(segments) > 0 {
+		nextSeq = segmentSeq(segments[len(segments)-1]) + 1
+	}
+	w := &wal{
+		cfg:     cfg,
+		nextSeq: nextSeq,
+		stop:    make(chan struct{}),
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.fsyncInterval > 0 {
+		w.wg.Add(1)
+		go w.fsyncLoop()
+	}
+
+	return w, nil
+}
+
+func (w *wal) fsyncLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.cfg.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.file != nil {
+				if err := w.file.Sync(); err != nil {
+					log.Error(3, "wal: periodic fsync failed: %s", err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *wal) rotate() error {
+	if w.file != nil {
+		_ = w.file.Close()
+	}
+	path := segmentPath(w.cfg.Dir, w.nextSeq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("wal: failed to open segment %s: %w", path, err)
+	}
+	w.file = f
+	w.path = path
+	w.size = 0
+	w.nextSeq++
+	return nil
+}
+
+// activeSegment returns the path of the segment currently open for
+// appends, so the compactor can leave it untouched: only sealed, rotated
+// out segments are safe to rewrite and remove.
+func (w *wal) activeSegment() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.path
+}
+
+// resyncSeq bumps nextSeq so that the next rotate() won't reuse a segment
+// number the compactor just installed into the live directory.
+func (w *wal) resyncSeq(minNext int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if minNext > w.nextSeq {
+		w.nextSeq = minNext
+	}
+}
+
+// Append persists a single accounting event. It is a no-op for event types
+// the WAL doesn't care to replay (e.g. evnt_get_total).
+func (w *wal) Append(t uint8, pl interface{}) error {
+	rec, ok := encodeRecord(t, pl)
+	if !ok {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size+int64(len(rec)) > w.cfg.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(rec)
+	if err != nil {
+		return err
+	}
+	w.size += int64(n)
+
+	if w.cfg.FsyncPolicy == "always" {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// Close stops the background fsync loop and closes the active segment.
+func (w *wal) Close() error {
+	close(w.stop)
+	w.wg.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// encodeRecord serializes one event as: 1 byte type, 4 byte payload length
+// (big endian), payload, 4 byte crc32 (IEEE) of the type+length+payload.
+func encodeRecord(t uint8, pl interface{}) ([]byte, bool) {
+	var recType byte
+	var payload []byte
+
+	switch t {
+	case evnt_add_chnk:
+		p := pl.(*AddPayload)
+		payload = make([]byte, 2+len(p.metric)+4+8)
+		off := putString(payload, 0, p.metric)
+		binary.BigEndian.PutUint32(payload[off:], p.ts)
+		binary.BigEndian.PutUint64(payload[off+4:], p.size)
+		recType = walRecAdd
+	case evnt_hit_chnk:
+		p := pl.(*HitPayload)
+		payload = make([]byte, 2+len(p.metric)+4)
+		off := putString(payload, 0, p.metric)
+		binary.BigEndian.PutUint32(payload[off:], p.ts)
+		recType = walRecHit
+	case evnt_del_met:
+		p := pl.(*DelMetPayload)
+		payload = make([]byte, 2+len(p.metric))
+		putString(payload, 0, p.metric)
+		recType = walRecDel
+	case evnt_reset:
+		recType = walRecReset
+	default:
+		return nil, false
+	}
+
+	header := make([]byte, 5)
+	header[0] = recType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+
+	sum := crc32.ChecksumIEEE(append(append([]byte{}, header...), payload...))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, sum)
+
+	rec := make([]byte, 0, len(header)+len(payload)+len(crc))
+	rec = append(rec, header...)
+	rec = append(rec, payload...)
+	rec = append(rec, crc...)
+	return rec, true
+}
+
+func putString(buf []byte, off int, s string) int {
+	binary.BigEndian.PutUint16(buf[off:], uint16(len(s)))
+	copy(buf[off+2:], s)
+	return off + 2 + len(s)
+}
+
+// replayWAL reads every segment in the WAL directory, in order, and invokes
+// apply for each valid decoded record. A segment's final record may be
+// truncated if the process crashed mid-write; replay of that segment stops at
+// the first such corrupt/incomplete record, without an error, and replayWAL
+// goes on with the next segment instead of failing the whole replay.
+func replayWAL(dir string, apply func(t uint8, pl interface{})) error {
+	segments, err := listWALSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range segments {
+		if err := replaySegment(path, apply); err != nil {
+			return fmt.Errorf("wal: failed to replay %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func replaySegment(path string, apply func(t uint8, pl interface{})) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(f, header); err != nil {
+			return nil // EOF or a truncated trailing record: stop replaying this segment
+		}
+		recType := header[0]
+		length := binary.BigEndian.Uint32(header[1:])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(f, payload); err != nil {
+			return nil
+		}
+
+		crcBuf := make([]byte, 4)
+		if _, err := io.ReadFull(f, crcBuf); err != nil {
+			return nil
+		}
+
+		want := binary.BigEndian.Uint32(crcBuf)
+		got := crc32.ChecksumIEEE(append(append([]byte{}, header...), payload...))
+		if want != got {
+			return nil // corrupt trailing record, stop here
+		}
+
+		t, pl, ok := decodeRecord(recType, payload)
+		if !ok {
+			continue
+		}
+		apply(t, pl)
+	}
+}
+
+func decodeRecord(recType byte, payload []byte) (uint8, interface{}, bool) {
+	switch recType {
+	case walRecAdd:
+		metric, off := getString(payload, 0)
+		ts := binary.BigEndian.Uint32(payload[off:])
+		size := binary.BigEndian.Uint64(payload[off+4:])
+		return evnt_add_chnk, &AddPayload{metric: metric, ts: ts, size: size}, true
+	case walRecHit:
+		metric, off := getString(payload, 0)
+		ts := binary.BigEndian.Uint32(payload[off:])
+		return evnt_hit_chnk, &HitPayload{metric: metric, ts: ts}, true
+	case walRecDel:
+		metric, _ := getString(payload, 0)
+		return evnt_del_met, &DelMetPayload{metric: metric}, true
+	case walRecReset:
+		return evnt_reset, nil, true
+	default:
+		return 0, nil, false
+	}
+}
+
+func getString(buf []byte, off int) (string, int) {
+	l := int(binary.BigEndian.Uint16(buf[off:]))
+	return string(buf[off+2 : off+2+l]), off + 2 + l
+}
+
+func segmentPath(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%010d%s", walSegmentPrefix, seq, walSegmentSuffix))
+}
+
+// listWALSegments returns every segment file in dir, sorted by sequence
+// number (oldest first).
+func listWALSegments(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		segments = append(segments, filepath.Join(dir, name))
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segmentSeq(segments[i]) < segmentSeq(segments[j])
+	})
+	return segments, nil
+}
+
+func segmentSeq(path string) int {
+	name := filepath.Base(path)
+	name = strings.TrimPrefix(name, walSegmentPrefix)
+	name = strings.TrimSuffix(name, walSegmentSuffix)
+	n, _ := strconv.Atoi(name)
+	return n
+}
@@ -0,0 +1,218 @@
+package accnt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// compactor periodically rewrites the WAL to keep it bounded: it collapses
+// every metric down to its add records plus the single most recent hit per
+// chunk, drops everything belonging to metrics that have since been
+// delMet'd, and drops everything before the most recent Reset(), since none
+// of that history is needed to reconstruct current accounting state.
+type compactor struct {
+	cfg *WALConfig
+	// activeSegment returns the path of the segment the live wal currently
+	// has open for Append, so the compactor never rewrites or removes it.
+	activeSegment func() string
+	// resyncSeq tells the live wal not to reuse any segment number below
+	// minNext, since compaction may install freshly renumbered segments.
+	resyncSeq func(minNext int)
+	// liveMetrics returns a snapshot of the metrics still tracked by the
+	// accounting (i.e. haven't been delMet'd), so their WAL history can be
+	// kept. It's a snapshot, not a per-call query, since a.metrics is only
+	// safe to read from FlatAccnt's own eventLoop goroutine.
+	liveMetrics func() map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startCompactor(cfg *WALConfig, w *wal, liveMetrics func() map[string]bool) *compactor {
+	c := &compactor{
+		cfg:           cfg,
+		activeSegment: w.activeSegment,
+		resyncSeq:     w.resyncSeq,
+		liveMetrics:   liveMetrics,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *compactor) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.cfg.CompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.compactOnce(); err != nil {
+				log.Error(3, "wal: compaction failed: %s", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *compactor) Stop() {
+	close(c.stop)
+	<-c.done
+}
+
+// compactOnce rewrites every sealed (rotated-out) segment into a fresh set
+// of segments under a tmp subdirectory, then installs them into the live
+// directory in place of the originals. The segment the live wal currently
+// has open for Append is left untouched throughout, so concurrent Append
+// calls are never disrupted.
+func (c *compactor) compactOnce() error {
+	all, err := listWALSegments(c.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	active := c.activeSegment()
+	var segments []string
+	maxExistingSeq := 0
+	for _, path := range all {
+		if seq := segmentSeq(path); seq > maxExistingSeq {
+			maxExistingSeq = seq
+		}
+		if path != active {
+			segments = append(segments, path)
+		}
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// Reserve the sequence range compaction might install *before* doing the
+	// slow replay/rewrite below, not after. Otherwise, while this pass is
+	// still replaying/rewriting, a live rotate() could assign the exact
+	// sequence number we later os.Rename a compacted segment onto, silently
+	// orphaning whatever the live wal appends to that file afterwards.
+	// Compaction only ever drops records (redundant hits, delMet'd metrics),
+	// but it rewrites the survivors in a different order, so they can pack
+	// into more segments than the sealed inputs did. Each output segment is
+	// only rotated out once the next record doesn't fit, so any two
+	// consecutive output segments together exceed SegmentSize; with at most
+	// len(segments)*SegmentSize bytes of input that bounds the output at
+	// 2*len(segments) segments, which is what gets reserved here.
+	c.resyncSeq(maxExistingSeq + 1 + 2*len(segments))
+
+	type chunkState struct {
+		add    *AddPayload
+		hit    *HitPayload
+		hitSeq int
+	}
+	live := make(map[EvictTarget]*chunkState)
+	seq := 0
+
+	for _, path := range segments {
+		err := replaySegment(path, func(t uint8, pl interface{}) {
+			seq++
+			switch t {
+			case evnt_add_chnk:
+				p := pl.(*AddPayload)
+				key := EvictTarget{Metric: p.metric, Ts: p.ts}
+				live[key] = &chunkState{add: p}
+			case evnt_hit_chnk:
+				p := pl.(*HitPayload)
+				key := EvictTarget{Metric: p.metric, Ts: p.ts}
+				if st, ok := live[key]; ok {
+					st.hit = p
+					st.hitSeq = seq
+				}
+			case evnt_del_met:
+				p := pl.(*DelMetPayload)
+				for key := range live {
+					if key.Metric == p.metric {
+						delete(live, key)
+					}
+				}
+			case evnt_reset:
+				// a Reset() wipes every metric that came before it; nothing
+				// earlier in the WAL is worth keeping.
+				live = make(map[EvictTarget]*chunkState)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// drop anything belonging to a metric that's since been delMet'd from
+	// the live accounting too, in case a delMet landed after our last
+	// segment was written but before this pass started.
+	liveMetrics := c.liveMetrics()
+	for key := range live {
+		if !liveMetrics[key.Metric] {
+			delete(live, key)
+		}
+	}
+
+	tmpDir := filepath.Join(c.cfg.Dir, ".compact-tmp")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	tmpCfg := *c.cfg
+	tmpCfg.Dir = tmpDir
+	w, err := openWAL(&tmpCfg)
+	if err != nil {
+		return err
+	}
+
+	for _, st := range live {
+		if err := w.Append(evnt_add_chnk, st.add); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+	for _, st := range live {
+		if st.hit != nil {
+			if err := w.Append(evnt_hit_chnk, st.hit); err != nil {
+				_ = w.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// Install the rewritten segments under fresh sequence numbers, starting
+	// past every segment (including the active one) already in the live
+	// dir, so installing can never collide with - and overwrite - an
+	// original that's still waiting to be removed. Only once every
+	// replacement is durably in place do we remove the originals. If we
+	// crash partway through, the live dir ends up with both the
+	// not-yet-removed originals and some already-installed replacements,
+	// which the next compaction pass cleans up; nothing is ever lost.
+	rewritten, err := listWALSegments(tmpDir)
+	if err != nil {
+		return err
+	}
+	nextSeq := maxExistingSeq + 1
+	for _, path := range rewritten {
+		dst := segmentPath(c.cfg.Dir, nextSeq)
+		if err := os.Rename(path, dst); err != nil {
+			return fmt.Errorf("wal: failed to install compacted segment %s: %w", dst, err)
+		}
+		nextSeq++
+	}
+	c.resyncSeq(nextSeq)
+
+	for _, path := range segments {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("wal: failed to remove compacted segment %s: %w", path, err)
+		}
+	}
+
+	return os.RemoveAll(tmpDir)
+}
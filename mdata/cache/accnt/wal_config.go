@@ -0,0 +1,92 @@
+package accnt
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+// WALConfig controls the optional write-ahead log that lets FlatAccnt
+// reconstruct its accounting state (and hence which chunks are hot) across
+// restarts, instead of starting every restart with an empty cache history.
+type WALConfig struct {
+	Enabled bool
+	Dir     string
+	// SegmentSize is the max size, in bytes, of a single WAL segment file
+	// before a new one is rotated in.
+	SegmentSize int64
+	// FsyncPolicy is one of "always", "interval:Xms" or "never".
+	FsyncPolicy   string
+	fsyncInterval time.Duration // parsed out of FsyncPolicy when it's "interval:..."
+	// CompactInterval is how often the background compactor rewrites
+	// segments to drop redundant hits and deleted metrics.
+	CompactInterval time.Duration
+}
+
+func (cfg *WALConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Dir == "" {
+		return fmt.Errorf("wal-dir must be set when the accounting WAL is enabled")
+	}
+	if cfg.SegmentSize <= 0 {
+		return fmt.Errorf("wal-segment-size must be > 0")
+	}
+
+	switch {
+	case cfg.FsyncPolicy == "always", cfg.FsyncPolicy == "never":
+	case strings.HasPrefix(cfg.FsyncPolicy, "interval:"):
+		ms := strings.TrimSuffix(strings.TrimPrefix(cfg.FsyncPolicy, "interval:"), "ms")
+		n, err := strconv.Atoi(ms)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("wal-fsync-policy interval must look like interval:100ms")
+		}
+		cfg.fsyncInterval = time.Duration(n) * time.Millisecond
+	default:
+		return fmt.Errorf("wal-fsync-policy must be one of always|interval:Xms|never")
+	}
+
+	if cfg.CompactInterval <= 0 {
+		return fmt.Errorf("wal-compact-interval must be > 0")
+	}
+
+	return nil
+}
+
+// return WALConfig with default values set. WAL is disabled by default,
+// which preserves the historical in-memory-only accounting behavior.
+func NewWALConfig() *WALConfig {
+	return &WALConfig{
+		Enabled:         false,
+		Dir:             "",
+		SegmentSize:     64 * 1024 * 1024,
+		FsyncPolicy:     "interval:100ms",
+		CompactInterval: time.Hour,
+	}
+}
+
+var WALCliConfig = NewWALConfig()
+
+func ConfigSetupWAL() {
+	wal := flag.NewFlagSet("chunk-cache-wal", flag.ExitOnError)
+
+	wal.BoolVar(&WALCliConfig.Enabled, "wal-enabled", WALCliConfig.Enabled, "persist chunk-cache accounting events to a write-ahead log and replay it on startup")
+	wal.StringVar(&WALCliConfig.Dir, "wal-dir", WALCliConfig.Dir, "directory to store WAL segments in")
+	wal.Int64Var(&WALCliConfig.SegmentSize, "wal-segment-size", WALCliConfig.SegmentSize, "max size in bytes of a single WAL segment before a new one is rotated in")
+	wal.StringVar(&WALCliConfig.FsyncPolicy, "wal-fsync-policy", WALCliConfig.FsyncPolicy, "when to fsync WAL writes: always|interval:Xms|never")
+	wal.DurationVar(&WALCliConfig.CompactInterval, "wal-compact-interval", WALCliConfig.CompactInterval, "how often the background compactor rewrites WAL segments")
+
+	globalconf.Register("chunk-cache-wal", wal)
+}
+
+func ConfigProcessWAL() {
+	if err := WALCliConfig.Validate(); err != nil {
+		log.Fatal(3, "chunk-cache-wal: config validation error. %s", err)
+	}
+}
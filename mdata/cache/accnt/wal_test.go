@@ -0,0 +1,355 @@
+package accnt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testWALConfig(dir string) *WALConfig {
+	return &WALConfig{
+		Enabled:         true,
+		Dir:             dir,
+		SegmentSize:     1024 * 1024,
+		FsyncPolicy:     "never",
+		CompactInterval: time.Hour,
+	}
+}
+
+func TestWALAppendReplayRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(testWALConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_hit_chnk, &HitPayload{metric: "a", ts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_del_met, &DelMetPayload{metric: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint8
+	err = replayWAL(dir, func(typ uint8, pl interface{}) {
+		got = append(got, typ)
+		switch typ {
+		case evnt_add_chnk:
+			p := pl.(*AddPayload)
+			if p.metric != "a" || p.ts != 1 || p.size != 10 {
+				t.Fatalf("unexpected add payload: %+v", p)
+			}
+		case evnt_hit_chnk:
+			p := pl.(*HitPayload)
+			if p.metric != "a" || p.ts != 1 {
+				t.Fatalf("unexpected hit payload: %+v", p)
+			}
+		case evnt_del_met:
+			p := pl.(*DelMetPayload)
+			if p.metric != "b" {
+				t.Fatalf("unexpected delMet payload: %+v", p)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 replayed records, got %d: %v", len(got), got)
+	}
+}
+
+func TestWALReplaySurvivesReset(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(testWALConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_reset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "b", ts: 2, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	live := make(map[string]bool)
+	err = replayWAL(dir, func(typ uint8, pl interface{}) {
+		switch typ {
+		case evnt_add_chnk:
+			live[pl.(*AddPayload).metric] = true
+		case evnt_reset:
+			live = make(map[string]bool)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if live["a"] {
+		t.Fatal("expected the reset to wipe the metric added before it")
+	}
+	if !live["b"] {
+		t.Fatal("expected the metric added after the reset to survive replay")
+	}
+}
+
+func TestWALReplayStopsAtCorruptTrailingRecord(t *testing.T) {
+	dir := t.TempDir()
+	w, err := openWAL(testWALConfig(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "b", ts: 2, size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := listWALSegments(dir)
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("expected one segment, got %v (err %v)", segments, err)
+	}
+
+	// simulate a crash mid-write: truncate off the last few bytes of the
+	// trailing record so its crc32 (or length prefix) no longer validates.
+	fi, err := os.Stat(segments[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segments[0], fi.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = replayWAL(dir, func(typ uint8, pl interface{}) {
+		got = append(got, pl.(*AddPayload).metric)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != "a" {
+		t.Fatalf("expected replay to stop after the first intact record, got %v", got)
+	}
+}
+
+func TestCompactOnceInstallsBeforeRemovingOriginals(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testWALConfig(dir)
+	w, err := openWAL(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first segment: an add plus a stale hit, rotated out so it's eligible
+	// for compaction.
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_hit_chnk, &HitPayload{metric: "a", ts: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := listWALSegments(dir)
+	if err != nil || len(before) != 2 {
+		t.Fatalf("expected 2 segments before compaction, got %v (err %v)", before, err)
+	}
+
+	c := startCompactor(cfg, w, func() map[string]bool {
+		return map[string]bool{"a": true}
+	})
+	c.Stop()
+
+	if err := c.compactOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := listWALSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".compact-tmp")); !os.IsNotExist(err) {
+		t.Fatalf("expected .compact-tmp to be cleaned up, got err %v", err)
+	}
+
+	var sawAdd, sawHit bool
+	err = replayWAL(dir, func(typ uint8, pl interface{}) {
+		switch typ {
+		case evnt_add_chnk:
+			sawAdd = true
+		case evnt_hit_chnk:
+			sawHit = true
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sawAdd || !sawHit {
+		t.Fatalf("expected the compacted segment to still carry the live metric's add+hit, sawAdd=%v sawHit=%v", sawAdd, sawHit)
+	}
+
+	// the active segment (still open for Append, empty) must never be
+	// touched by compaction.
+	foundActive := false
+	for _, path := range after {
+		if path == w.activeSegment() {
+			foundActive = true
+		}
+	}
+	if !foundActive {
+		t.Fatal("expected the active segment to survive compaction untouched")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactOnceDropsHistoryBeforeReset(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testWALConfig(dir)
+	w, err := openWAL(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first segment: a metric added, then reset, then a metric added after
+	// the reset - rotated out so it's eligible for compaction.
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_reset, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "b", ts: 2, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startCompactor(cfg, w, func() map[string]bool {
+		return map[string]bool{"b": true}
+	})
+	c.Stop()
+
+	if err := c.compactOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	live := make(map[string]bool)
+	err = replayWAL(dir, func(typ uint8, pl interface{}) {
+		if typ == evnt_add_chnk {
+			live[pl.(*AddPayload).metric] = true
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live["a"] {
+		t.Fatal("expected compaction to drop the metric added before the reset")
+	}
+	if !live["b"] {
+		t.Fatal("expected compaction to keep the metric added after the reset")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCompactOnceReservesSeqRangeBeforeRewrite simulates the live wal
+// rotating the instant compaction reserves its install sequence range -
+// exactly the race window a too-late resyncSeq call used to leave open. If
+// the reservation happened after the (slow) replay/rewrite instead of
+// before it, the newly rotated live segment would land on a sequence number
+// compaction later installs a rewritten segment onto, silently orphaning
+// whatever got appended to it.
+func TestCompactOnceReservesSeqRangeBeforeRewrite(t *testing.T) {
+	dir := t.TempDir()
+	cfg := testWALConfig(dir)
+	w, err := openWAL(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "a", ts: 1, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Append(evnt_add_chnk, &AddPayload{metric: "b", ts: 2, size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var liveSegmentAfterRotate string
+	rotated := false
+	c := &compactor{
+		cfg:           cfg,
+		activeSegment: w.activeSegment,
+		resyncSeq: func(minNext int) {
+			w.resyncSeq(minNext)
+			if rotated {
+				return
+			}
+			rotated = true
+			if err := w.rotate(); err != nil {
+				t.Fatal(err)
+			}
+			liveSegmentAfterRotate = w.activeSegment()
+			if err := w.Append(evnt_add_chnk, &AddPayload{metric: "live-after-rotate", ts: 3, size: 10}); err != nil {
+				t.Fatal(err)
+			}
+		},
+		liveMetrics: func() map[string]bool { return map[string]bool{"a": true, "b": true} },
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	if err := c.compactOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("expected resyncSeq to be invoked before the rewrite completed")
+	}
+
+	var sawLiveAfterRotate bool
+	if err := replaySegment(liveSegmentAfterRotate, func(typ uint8, pl interface{}) {
+		if typ == evnt_add_chnk && pl.(*AddPayload).metric == "live-after-rotate" {
+			sawLiveAfterRotate = true
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !sawLiveAfterRotate {
+		t.Fatal("expected the segment the live wal rotated into mid-compaction to still carry what was appended to it")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}